@@ -5,11 +5,19 @@
 package main
 
 import (
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/attic-labs/noms/go/config"
@@ -22,10 +30,30 @@ import (
 	"github.com/attic-labs/noms/go/util/progressreader"
 	"github.com/attic-labs/noms/go/util/status"
 	"github.com/attic-labs/noms/go/util/verbose"
+	"github.com/attic-labs/noms/samples/go/url-fetch/manifest"
 	human "github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/zstd"
 	flag "gx/ipfs/QmQLaYRd41dEe13kYwHtKBfXkkZuXzAEsKz56FA17NNT8A/gnuflag"
 )
 
+// maxFetchRetries bounds how many times fetchURL will reattempt a broken
+// connection before giving up on resuming the fetch.
+const maxFetchRetries = 8
+
+// maxFetchRestarts bounds how many times fetchHTTPAndBuildBlob will redo an entire
+// fetch from byte 0 after the server stops honoring a Range request
+// mid-stream (see resumingBody).
+const maxFetchRestarts = 3
+
+// errRestartRequired is what reopen returns when the server responds to a
+// Range retry with something other than 206: the resume can't continue, and
+// the only way forward is a fresh fetch from byte 0.
+var errRestartRequired = errors.New("server did not honor the range request; a full restart is required")
+
+// maxPollBackoff caps the exponential backoff applied between watch-mode
+// polls after a 5xx response.
+const maxPollBackoff = 5 * time.Minute
+
 var (
 	start time.Time
 )
@@ -34,21 +62,45 @@ func main() {
 	noProgress := flag.Bool("no-progress", false, "prevents progress from being output if true")
 	performCommit := flag.Bool("commit", true, "commit the data to head of the dataset (otherwise only write the data to the dataset)")
 	stdin := flag.Bool("stdin", false, "read blob from stdin")
+	resumeFromHead := flag.Bool("resume-from-head", false, "if the previous commit's blob came from this url and the server still matches its Etag or Last-Modified, request only the bytes past that blob's length (Range/If-Range) and build the new blob from the stored prefix plus that suffix; chunks are not checked for presence in the database before they are written; has no effect when the content is being decompressed, since a compressed stream can't be resumed from a decompressed byte offset")
+	watch := flag.Duration("watch", 0, "if non-zero, keep running and re-fetch the url on this interval instead of exiting after the first fetch")
+	maxCommits := flag.Int("max-commits", 0, "in --watch mode, stop after making this many commits (0 means unbounded)")
+	jitter := flag.Duration("jitter", 0, "in --watch mode, add up to this much random jitter to each poll interval")
+	statusAddr := flag.String("status-addr", "", "in --watch mode, serve last-fetch status as JSON on this address (e.g. ':8080')")
+	manifestPath := flag.String("manifest", "", "path to a JSON manifest of {url, dataset, headers, decompress, sha256} entries to fetch as a batch, instead of a single url-or-local-path/dataset pair")
+	manifestDB := flag.String("db", "", "database spec the --manifest datasets are resolved against (e.g. 'ldb:/path' or a server address)")
+	parallel := flag.Int("parallel", 4, "in --manifest mode, number of entries to fetch concurrently")
+	decompress := flag.String("decompress", "auto", "how to decompress the fetched content before storing it: auto, gzip, zstd, bzip2, or none. auto inspects Content-Encoding, falling back to the source's file extension")
+	expectSHA256 := flag.String("expect-sha256", "", "if set, the post-decompression content must hash to this sha256 (hex); the commit is aborted on a mismatch")
 
 	spec.RegisterCommitMetaFlags(flag.CommandLine)
 	verbose.RegisterVerboseFlags(flag.CommandLine)
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Fetches a URL, file, or stdin into a noms blob\n\nUsage: %s [--stdin?] [url-or-local-path?] [dataset]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Fetches a URL, file, or stdin into a noms blob\n\nUsage: %s [--stdin?] [url-or-local-path?] [dataset]\n       %s --manifest=jobs.json --db=<db-spec>\n", os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.Parse(true)
 
+	if *manifestPath != "" {
+		if *manifestDB == "" {
+			fmt.Fprintf(os.Stderr, "--manifest requires --db\n")
+			exit.Fail()
+		}
+		runManifest(*manifestPath, *manifestDB, *parallel, *performCommit)
+		return
+	}
+
 	if !(*stdin && flag.NArg() == 1) && flag.NArg() != 2 {
 		flag.Usage()
 		exit.Fail()
 	}
 
+	if *watch > 0 && *stdin {
+		fmt.Fprintf(os.Stderr, "--watch cannot be used with --stdin\n")
+		exit.Fail()
+	}
+
 	start = time.Now()
 
 	cfg := config.NewResolver()
@@ -56,107 +108,742 @@ func main() {
 	d.CheckErrorNoUsage(err)
 	defer db.Close()
 
-	var r io.Reader
-	var contentLength int64
+	opts := fetchOpts{
+		stdin:          *stdin,
+		resumeFromHead: *resumeFromHead,
+		noProgress:     *noProgress,
+		performCommit:  *performCommit,
+		source:         flag.Arg(0),
+		decompress:     *decompress,
+		expectSHA256:   *expectSHA256,
+	}
+
+	if *watch <= 0 {
+		outcome, err := fetchAndCommit(db, &ds, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return
+		}
+		printOutcome(outcome)
+		return
+	}
+
+	runWatch(db, &ds, opts, *watch, *maxCommits, *jitter, *statusAddr)
+}
+
+// fetchOpts bundles the flags that control a single fetch-and-commit
+// attempt, so the same logic can be driven either once or repeatedly by
+// runWatch.
+type fetchOpts struct {
+	stdin          bool
+	resumeFromHead bool
+	noProgress     bool
+	performCommit  bool
+	source         string
+	headers        map[string]string
+	decompress     string // "auto", "gzip", "zstd", "bzip2", or "none"
+	expectSHA256   string
+}
+
+const (
+	decompressAuto  = "auto"
+	decompressGzip  = "gzip"
+	decompressZstd  = "zstd"
+	decompressBzip2 = "bzip2"
+	decompressNone  = "none"
+)
+
+// outcome describes what happened on one fetch-and-commit attempt.
+type outcome struct {
+	statusCode  int // 0 for non-HTTP sources
+	notModified bool
+	committed   bool
+	bytes       int64
+	headHash    string
+}
+
+func printOutcome(o outcome) {
+	if o.notModified {
+		fmt.Fprintf(os.Stdout, "Content unchanged since last fetch, no commit made")
+		return
+	}
+	if !o.committed {
+		return
+	}
+	fmt.Fprintf(os.Stdout, "#%s\n", o.headHash)
+}
 
+// fetchAndCommit performs exactly one fetch of opts.source and, unless the
+// server reports the content is unchanged, writes it into db and (if
+// opts.performCommit) commits it to the head of ds.
+func fetchAndCommit(db datas.Database, ds *datas.Dataset, opts fetchOpts) (outcome, error) {
 	var root = struct {
 		Meta struct {
-			Etag string `noms:"etag,omitempty"`
-			File string `noms:"file,omitempty"`
-			URL  string `noms:"url,omitempty"`
+			Etag          string `noms:"etag,omitempty"`
+			LastModified  string `noms:"last_modified,omitempty"`
+			File          string `noms:"file,omitempty"`
+			URL           string `noms:"url,omitempty"`
+			ContentLength string `noms:"content_length,omitempty"`
+			Bytes         string `noms:"bytes,omitempty"`
 		}
 	}{}
 	if ds.HasHead() {
-		err = marshal.Unmarshal(ds.Head(), &root)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Could not unmarshal head: %s\n", err)
-			return
+		if err := marshal.Unmarshal(ds.Head(), &root); err != nil {
+			return outcome{}, fmt.Errorf("could not unmarshal head: %s", err)
 		}
 	}
 
+	var b types.Blob
+	var bytesWritten int64
 	additionalMetaInfo := map[string]string{}
-	if *stdin {
-		r = os.Stdin
-		contentLength = -1
-	} else if url := flag.Arg(0); strings.HasPrefix(url, "http") {
-		req, err := http.NewRequest(http.MethodGet, url, nil)
+	statusCode := 0
+
+	if strings.HasPrefix(opts.source, "http") {
+		url := opts.source
+
+		var prevBlob types.Blob
+		havePrevBlob := false
+		if ds.HasHead() {
+			if pb, ok := ds.Head().Get(datas.CommitValueField).(types.Blob); ok {
+				prevBlob, havePrevBlob = pb, true
+			}
+		}
+
+		etagHint, lastModifiedHint := "", ""
+		if root.Meta.URL == url {
+			etagHint, lastModifiedHint = root.Meta.Etag, root.Meta.LastModified
+		}
+		validator := etagHint
+		if validator == "" {
+			validator = lastModifiedHint
+		}
+
+		var notModified bool
+		var meta map[string]string
+		var err error
+		b, statusCode, notModified, meta, bytesWritten, err = fetchHTTPAndBuildBlob(db, url, prevBlob, havePrevBlob, validator, etagHint, lastModifiedHint, opts)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Could not build http request for url %s, error: %s\n", url, err)
-			return
+			return outcome{statusCode: statusCode}, err
 		}
+		if notModified {
+			return outcome{statusCode: statusCode, notModified: true}, nil
+		}
+		for k, v := range meta {
+			additionalMetaInfo[k] = v
+		}
+	} else {
+		var r io.Reader
+		var contentLength int64
+		if opts.stdin {
+			r = os.Stdin
+			contentLength = -1
+		} else {
+			// assume it's a file
+			f, err := os.Open(opts.source)
+			if err != nil {
+				return outcome{}, fmt.Errorf("invalid URL %s - does not start with 'http' and isn't local file either. fopen error: %s", opts.source, err)
+			}
+			defer f.Close()
+
+			s, err := f.Stat()
+			if err != nil {
+				return outcome{}, fmt.Errorf("could not stat file %s: %s", opts.source, err)
+			}
 
-		if root.Meta.URL == url && root.Meta.Etag != "" {
-			req.Header.Set("If-None-Match", root.Meta.Etag)
+			r = f
+			contentLength = s.Size()
+			additionalMetaInfo["file"] = opts.source
 		}
 
-		resp, err := http.DefaultClient.Do(req)
+		compressedCounter := &countingReader{r: r}
+		r = compressedCounter
+
+		mode := resolveDecompressMode(opts.decompress, "", opts.source)
+		decompressed, err := wrapDecompressor(mode, r)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Could not fetch url %s, error: %s\n", url, err)
-			return
+			return outcome{}, fmt.Errorf("could not decompress %s: %s", opts.source, err)
+		}
+		r = decompressed
+		if mode != decompressNone {
+			contentLength = -1 // the decompressed size isn't known up front
 		}
 
-		if resp.StatusCode == http.StatusNotModified {
-			fmt.Fprintf(os.Stdout, "Content unchanged since last fetch, no commit made")
-			return
+		hasher := sha256.New()
+		if opts.expectSHA256 != "" {
+			r = io.TeeReader(r, hasher)
 		}
 
-		switch resp.StatusCode / 100 {
-		case 4, 5:
-			fmt.Fprintf(os.Stderr, "Could not fetch url %s, error: %d (%s)\n", url, resp.StatusCode, resp.Status)
-			return
+		counter := &countingReader{r: r}
+		r = counter
+		if !opts.noProgress {
+			r = progressreader.New(r, getStatusPrinter(contentLength))
 		}
+		b = types.NewBlob(db, r)
 
-		r = resp.Body
-		contentLength = resp.ContentLength
-		additionalMetaInfo["url"] = url
-		if etag := resp.Header.Get("Etag"); etag != "" {
-			additionalMetaInfo["etag"] = etag
+		if opts.expectSHA256 != "" {
+			if got := hex.EncodeToString(hasher.Sum(nil)); !strings.EqualFold(got, opts.expectSHA256) {
+				return outcome{}, fmt.Errorf("sha256 mismatch for %s: expected %s, got %s", opts.source, opts.expectSHA256, got)
+			}
+		}
+
+		bytesWritten = counter.n
+		additionalMetaInfo["bytes"] = fmt.Sprintf("%d", counter.n)
+		additionalMetaInfo["compressed_bytes"] = fmt.Sprintf("%d", compressedCounter.n)
+		if mode == decompressNone && contentLength >= 0 {
+			additionalMetaInfo["content_length"] = fmt.Sprintf("%d", contentLength)
 		}
+	}
+
+	if !opts.performCommit {
+		ref := db.WriteValue(b)
+		if !opts.noProgress {
+			status.Clear()
+		}
+		return outcome{statusCode: statusCode, bytes: bytesWritten, headHash: ref.TargetHash().String()}, nil
+	}
+
+	meta, err := spec.CreateCommitMetaStruct(db, "", "", additionalMetaInfo, nil)
+	if err != nil {
+		return outcome{}, err
+	}
+	newHead, err := db.Commit(*ds, b, datas.CommitOptions{Meta: meta})
+	if err != nil {
+		d.Chk.Equal(datas.ErrMergeNeeded, err)
+		return outcome{statusCode: statusCode}, fmt.Errorf("could not commit, optimistic concurrency failed")
+	}
+	*ds = newHead
+	if !opts.noProgress {
+		status.Done()
+	}
+	return outcome{statusCode: statusCode, committed: true, bytes: bytesWritten, headHash: ds.HeadRef().TargetHash().String()}, nil
+}
+
+// watchStats is what --status-addr serves, kept up to date as runWatch
+// polls.
+type watchStats struct {
+	mu               sync.Mutex
+	LastFetch        time.Time `json:"lastFetch"`
+	LastStatusCode   int       `json:"lastStatusCode"`
+	BytesTransferred int64     `json:"bytesTransferred"`
+	Commits          int       `json:"commits"`
+	Head             string    `json:"head"`
+	LastError        string    `json:"lastError,omitempty"`
+}
+
+func (s *watchStats) record(o outcome, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LastFetch = time.Now()
+	s.LastStatusCode = o.statusCode
+	if err != nil {
+		s.LastError = err.Error()
 	} else {
-		// assume it's a file
-		f, err := os.Open(url)
+		s.LastError = ""
+	}
+	if o.committed {
+		s.BytesTransferred = o.bytes
+		s.Commits++
+		s.Head = o.headHash
+	}
+}
+
+func (s *watchStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// runWatch re-runs fetchAndCommit every interval (plus up to jitter of
+// random slop) until maxCommits successful commits have been made (0 means
+// run forever). A 304 never counts as a commit. Consecutive 5xx responses
+// back the poll interval off exponentially, up to maxPollBackoff.
+func runWatch(db datas.Database, ds *datas.Dataset, opts fetchOpts, interval time.Duration, maxCommits int, jitter time.Duration, statusAddr string) {
+	stats := &watchStats{}
+	if statusAddr != "" {
+		go func() {
+			d.CheckErrorNoUsage(http.ListenAndServe(statusAddr, stats))
+		}()
+	}
+
+	commits := 0
+	backoff := time.Duration(0)
+	for {
+		o, err := fetchAndCommit(db, ds, opts)
+		stats.record(o, err)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid URL %s - does not start with 'http' and isn't local file either. fopen error: %s", url, err)
-			return
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		} else {
+			printOutcome(o)
 		}
 
-		s, err := f.Stat()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Could not stat file %s: %s", url, err)
-			return
+		if o.committed {
+			commits++
+			backoff = 0
+			if maxCommits > 0 && commits >= maxCommits {
+				return
+			}
+		} else if o.statusCode/100 == 5 {
+			if backoff == 0 {
+				backoff = time.Second
+			} else {
+				backoff *= 2
+			}
+			if backoff > maxPollBackoff {
+				backoff = maxPollBackoff
+			}
+		} else {
+			backoff = 0
+		}
+
+		sleep := interval + backoff
+		if jitter > 0 {
+			sleep += time.Duration(rand.Int63n(int64(jitter)))
+		}
+		time.Sleep(sleep)
+	}
+}
+
+// runManifest fetches every entry in the manifest at manifestPath, each
+// against its own dataset within the single database identified by dbSpec,
+// using up to parallel workers. Unlike the single-url path, a failed entry
+// doesn't abort the run: errors are collected and reported in the summary
+// printed at the end, and the process exits non-zero only if any entry
+// failed.
+func runManifest(manifestPath, dbSpec string, parallel int, performCommit bool) {
+	entries, err := manifest.Load(manifestPath)
+	d.CheckErrorNoUsage(err)
+
+	cfg := config.NewResolver()
+	db, err := cfg.GetDatabase(dbSpec)
+	d.CheckErrorNoUsage(err)
+	defer db.Close()
+
+	type result struct {
+		entry  manifest.Entry
+		status string
+		bytes  int64
+		err    error
+	}
+
+	jobs := make(chan manifest.Entry)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				ds := db.GetDataset(e.Dataset)
+				decompress := e.Decompress
+				if decompress == "" {
+					decompress = decompressAuto
+				}
+				o, err := fetchAndCommit(db, &ds, fetchOpts{
+					source: e.URL,
+					// progress output is always suppressed here: parallel
+					// workers writing to stdout/stderr concurrently would
+					// interleave into garbage, and the per-entry summary
+					// printed below is the only progress a manifest run needs.
+					noProgress:    true,
+					performCommit: performCommit,
+					headers:       e.Headers,
+					decompress:    decompress,
+					expectSHA256:  e.SHA256,
+				})
+				switch {
+				case err != nil:
+					results <- result{entry: e, status: "failed", err: err}
+				case o.notModified:
+					results <- result{entry: e, status: "not-modified"}
+				default:
+					results <- result{entry: e, status: "fetched", bytes: o.bytes}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for _, e := range entries {
+			jobs <- e
+		}
+		close(jobs)
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	failed := 0
+	for res := range results {
+		if res.err != nil {
+			failed++
+			fmt.Fprintf(os.Stdout, "%-40s failed: %s\n", res.entry.Dataset, res.err)
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "%-40s %s (%d bytes)\n", res.entry.Dataset, res.status, res.bytes)
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d entries failed\n", failed, len(entries))
+		exit.Fail()
+	}
+}
+
+// fetchHTTPAndBuildBlob fetches url and builds the noms blob for it,
+// reusing prevBlob's bytes instead of the network wherever possible:
+//
+//   - if opts.resumeFromHead and prevBlob is the full content of the last
+//     commit to this url (validator still matches), the request asks the
+//     server for only the bytes after prevBlob.Len() via Range/If-Range, and
+//     the blob is built from prevBlob.Reader() followed by that suffix, so
+//     the already-fetched prefix is never re-requested over the wire;
+//   - if the server can't honor that range mid-stream (reopen sees a
+//     non-206), the in-progress blob is discarded and the whole fetch is
+//     retried from byte 0, up to maxFetchRestarts times.
+//
+// Range resume is never attempted when decompression is in effect: prevBlob
+// holds the logical (decompressed) content, but a Range offset is
+// interpreted by the server against the wire (compressed) byte stream, and a
+// compressed stream can't be resumed mid-stream by decoding only the
+// returned suffix anyway. resolveDecompressMode is consulted up front with
+// no Content-Encoding (the response hasn't arrived yet) to skip the attempt
+// whenever --decompress names a concrete codec or the source's extension
+// would resolve "auto" to one; if the server still turns out to be sending a
+// compressed stream we didn't anticipate (Content-Encoding only, no
+// recognizable extension, --decompress=auto), the resumed response is
+// detected and discarded below, and the fetch restarts from byte 0 without
+// resume.
+func fetchHTTPAndBuildBlob(db datas.Database, url string, prevBlob types.Blob, havePrevBlob bool, validator, etagHint, lastModifiedHint string, opts fetchOpts) (b types.Blob, statusCode int, notModified bool, meta map[string]string, bytesWritten int64, err error) {
+	tryResume := opts.resumeFromHead && havePrevBlob && validator != "" && resolveDecompressMode(opts.decompress, "", url) == decompressNone
+
+	for attempt := 0; ; attempt++ {
+		var resp *http.Response
+		resumedFromOffset := false
+
+		if tryResume {
+			if rr, ok, rerr := tryRangeResume(url, validator, int64(prevBlob.Len()), opts.headers); rerr == nil && ok {
+				resp, resumedFromOffset = rr, true
+			}
+		}
+		if resp == nil {
+			resp, err = fetchURL(url, etagHint, lastModifiedHint, opts.headers)
+			if err != nil {
+				code := 0
+				if resp != nil {
+					code = resp.StatusCode
+				}
+				return types.Blob{}, code, false, nil, 0, fmt.Errorf("could not fetch url %s, error: %s", url, err)
+			}
+			if resp == nil {
+				return types.Blob{}, http.StatusNotModified, true, nil, 0, nil
+			}
+		}
+
+		statusCode = resp.StatusCode
+		m := map[string]string{"url": url}
+		if etag := resp.Header.Get("Etag"); etag != "" {
+			m["etag"] = etag
+		}
+		if lm := resp.Header.Get("Last-Modified"); lm != "" {
+			m["last_modified"] = lm
+		}
+		contentEncoding := resp.Header.Get("Content-Encoding")
+		if contentEncoding != "" {
+			m["content_encoding"] = contentEncoding
+		}
+
+		mode := resolveDecompressMode(opts.decompress, contentEncoding, url)
+		if resumedFromOffset && mode != decompressNone {
+			// The range offset we requested was prevBlob.Len(), a decompressed
+			// length, but the server is actually sending a compressed wire
+			// stream: the suffix we got back can't be decoded on its own.
+			// Discard it and restart the whole fetch from byte 0.
+			resp.Body.Close()
+			tryResume = false
+			continue
+		}
+
+		rb, _ := resp.Body.(*resumingBody)
+
+		compressedCounter := &countingReader{r: resp.Body}
+		decompressed, derr := wrapDecompressor(mode, compressedCounter)
+		if derr != nil {
+			resp.Body.Close()
+			return types.Blob{}, statusCode, false, nil, 0, fmt.Errorf("could not decompress %s: %s", url, derr)
+		}
+
+		var r io.Reader = decompressed
+		if resumedFromOffset {
+			r = io.MultiReader(prevBlob.Reader(), decompressed)
+		}
+
+		hasher := sha256.New()
+		if opts.expectSHA256 != "" {
+			r = io.TeeReader(r, hasher)
+		}
+		counter := &countingReader{r: r}
+		r = counter
+		if !opts.noProgress {
+			expectedLen := resp.ContentLength
+			if mode != decompressNone || resumedFromOffset || expectedLen < 0 {
+				expectedLen = -1
+			}
+			r = progressreader.New(r, getStatusPrinter(expectedLen))
+		}
+
+		blob := types.NewBlob(db, r)
+		resp.Body.Close()
+
+		if rb != nil && rb.restartNeeded {
+			if attempt >= maxFetchRestarts {
+				return types.Blob{}, statusCode, false, nil, 0, fmt.Errorf("giving up on %s after %d restarts", url, attempt)
+			}
+			tryResume = false // the retry fetches fresh from byte 0, no range
+			continue
+		}
+
+		if opts.expectSHA256 != "" {
+			if got := hex.EncodeToString(hasher.Sum(nil)); !strings.EqualFold(got, opts.expectSHA256) {
+				return types.Blob{}, statusCode, false, nil, 0, fmt.Errorf("sha256 mismatch for %s: expected %s, got %s", url, opts.expectSHA256, got)
+			}
 		}
 
-		r = f
-		contentLength = s.Size()
-		additionalMetaInfo["file"] = url
+		m["bytes"] = fmt.Sprintf("%d", counter.n)
+		m["compressed_bytes"] = fmt.Sprintf("%d", compressedCounter.n)
+		if mode == decompressNone && !resumedFromOffset && resp.ContentLength >= 0 {
+			m["content_length"] = fmt.Sprintf("%d", resp.ContentLength)
+		}
+		return blob, statusCode, false, m, counter.n, nil
+	}
+}
+
+// tryRangeResume asks the server for only the bytes after offset, using
+// If-Range so the server falls back to the full resource (rather than
+// returning a range of whatever it currently has) if validator no longer
+// matches. ok is true only on a 206; on any other outcome the caller should
+// fall back to a normal full fetch via fetchURL.
+func tryRangeResume(url, validator string, offset int64, headers map[string]string) (*http.Response, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	req.Header.Set("If-Range", validator)
+	for k, v := range headers {
+		req.Header.Set(k, v)
 	}
 
-	if !*noProgress {
-		r = progressreader.New(r, getStatusPrinter(contentLength))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, false, nil
 	}
-	b := types.NewBlob(db, r)
 
-	if *performCommit {
-		meta, err := spec.CreateCommitMetaStruct(db, "", "", additionalMetaInfo, nil)
-		d.CheckErrorNoUsage(err)
-		_, err = db.Commit(ds, b, datas.CommitOptions{Meta: meta})
+	wrapResumingBody(resp, url, validator, offset)
+	return resp, true, nil
+}
+
+// fetchURL issues the initial full request for url, revalidating against
+// etag or lastModified (from the previous commit, whichever is set) when
+// present, preferring etag since it's the stronger validator. It returns a
+// nil response (and no error) on a 304, and on a 4xx or 5xx the closed
+// response together with an error, so the caller can see the status code.
+// It asks for an identity encoding, so a gzip Content-Encoding the server
+// sends anyway reaches the caller undecoded. The returned response's Body
+// transparently resumes on a dropped connection: reads from it retry with
+// backoff, reopening the request with a Range header anchored at the last
+// byte successfully streamed, as long as the server keeps honoring that
+// range against the same validator.
+func fetchURL(url, etag, lastModified string, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	validator := etag
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	} else if lastModified != "" {
+		validator = lastModified
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+
+	switch resp.StatusCode / 100 {
+	case 4, 5:
+		resp.Body.Close()
+		return resp, fmt.Errorf("%d (%s)", resp.StatusCode, resp.Status)
+	}
+
+	wrapResumingBody(resp, url, validator, 0)
+	return resp, nil
+}
+
+// wrapResumingBody installs a resumingBody over resp.Body, anchored at
+// baseOffset (the logical byte position the body's first byte corresponds
+// to: 0 for a normal fetch, or the Range offset for a resumed one).
+func wrapResumingBody(resp *http.Response, url, validator string, baseOffset int64) {
+	resp.Body = &resumingBody{
+		url:          url,
+		validator:    validator,
+		body:         resp.Body,
+		baseOffset:   baseOffset,
+		lastModified: resp.Header.Get("Last-Modified"),
+		etag:         resp.Header.Get("Etag"),
+	}
+}
+
+// resumingBody wraps an in-flight HTTP response body and, on a transport
+// error partway through the stream, reopens the request with
+// "Range: bytes=N-" and "If-Range: <validator>" so the fetch can continue
+// rather than restarting from byte 0. If the server doesn't honor the range
+// (it replies something other than 206, e.g. because the resource changed),
+// resumption is impossible: noms blobs aren't seekable mid-construction, so
+// there's no way to splice a restarted stream into one that's already
+// partially written. In that case Read sets restartNeeded and returns
+// (n, io.EOF) to cleanly terminate the in-progress types.NewBlob call, and
+// the caller (fetchHTTPAndBuildBlob) discards the partial blob and restarts
+// the whole fetch from byte 0.
+type resumingBody struct {
+	url           string
+	validator     string
+	body          io.ReadCloser
+	baseOffset    int64
+	bytesRead     int64
+	etag          string
+	lastModified  string
+	retries       int
+	restartNeeded bool
+}
+
+func (b *resumingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.bytesRead += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	if rerr := b.reopen(); rerr != nil {
+		if rerr == errRestartRequired {
+			b.restartNeeded = true
+			return n, io.EOF
+		}
+		return n, err
+	}
+	return n, nil
+}
+
+func (b *resumingBody) reopen() error {
+	backoff := 500 * time.Millisecond
+	for b.retries < maxFetchRetries {
+		b.retries++
+		time.Sleep(backoff)
+		backoff *= 2
+
+		req, err := http.NewRequest(http.MethodGet, b.url, nil)
 		if err != nil {
-			d.Chk.Equal(datas.ErrMergeNeeded, err)
-			fmt.Fprintf(os.Stderr, "Could not commit, optimistic concurrency failed.")
-			return
+			return err
 		}
-		if !*noProgress {
-			status.Done()
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.baseOffset+b.bytesRead))
+		if b.etag != "" {
+			req.Header.Set("If-Range", b.etag)
+		} else if b.lastModified != "" {
+			req.Header.Set("If-Range", b.lastModified)
 		}
-	} else {
-		ref := db.WriteValue(b)
-		if !*noProgress {
-			status.Clear()
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return errRestartRequired
+		}
+
+		b.body.Close()
+		b.body = resp.Body
+		return nil
+	}
+	return fmt.Errorf("giving up resuming fetch of %s after %d attempts", b.url, b.retries)
+}
+
+func (b *resumingBody) Close() error {
+	return b.body.Close()
+}
+
+// resolveDecompressMode turns a requested --decompress value into a
+// concrete mode. "auto" prefers the Content-Encoding the server reported
+// and falls back to sniffing source's file extension (meaningful for the
+// --stdin and local-file cases, where there's no Content-Encoding).
+func resolveDecompressMode(requested, contentEncoding, source string) string {
+	if requested != decompressAuto {
+		return requested
+	}
+	switch contentEncoding {
+	case "gzip":
+		return decompressGzip
+	case "zstd":
+		return decompressZstd
+	case "bzip2":
+		return decompressBzip2
+	}
+	switch {
+	case strings.HasSuffix(source, ".gz"):
+		return decompressGzip
+	case strings.HasSuffix(source, ".zst"):
+		return decompressZstd
+	case strings.HasSuffix(source, ".bz2"):
+		return decompressBzip2
+	}
+	return decompressNone
+}
+
+// wrapDecompressor wraps r in the streaming decoder for mode, so the blob
+// ends up holding the logical (decompressed) content rather than the
+// wire-compressed bytes.
+func wrapDecompressor(mode string, r io.Reader) (io.Reader, error) {
+	switch mode {
+	case decompressGzip:
+		return gzip.NewReader(r)
+	case decompressBzip2:
+		return bzip2.NewReader(r), nil
+	case decompressZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
 		}
-		fmt.Fprintf(os.Stdout, "#%s\n", ref.TargetHash().String())
+		return zr.IOReadCloser(), nil
+	case decompressNone, "":
+		return r, nil
+	default:
+		return nil, fmt.Errorf("unknown --decompress mode %q", mode)
 	}
 }
 
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 func getStatusPrinter(expectedLen int64) progressreader.Callback {
 	return func(seenLen uint64) {
 		var expected string
@@ -0,0 +1,290 @@
+// Copyright 2016 Attic Labs, Inc. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/attic-labs/noms/go/chunks"
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/types"
+)
+
+func TestResolveDecompressMode(t *testing.T) {
+	tests := []struct {
+		name            string
+		requested       string
+		contentEncoding string
+		source          string
+		want            string
+	}{
+		{"explicit mode wins", "gzip", "", "foo.tar", decompressGzip},
+		{"explicit none wins over content-encoding", "none", "gzip", "foo.tar.gz", decompressNone},
+		{"auto prefers content-encoding gzip", decompressAuto, "gzip", "foo", decompressGzip},
+		{"auto prefers content-encoding zstd", decompressAuto, "zstd", "foo", decompressZstd},
+		{"auto prefers content-encoding bzip2", decompressAuto, "bzip2", "foo", decompressBzip2},
+		{"auto falls back to .gz extension", decompressAuto, "", "foo.gz", decompressGzip},
+		{"auto falls back to .zst extension", decompressAuto, "", "foo.zst", decompressZstd},
+		{"auto falls back to .bz2 extension", decompressAuto, "", "foo.bz2", decompressBzip2},
+		{"auto defaults to none", decompressAuto, "", "foo.txt", decompressNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveDecompressMode(tt.requested, tt.contentEncoding, tt.source); got != tt.want {
+				t.Errorf("resolveDecompressMode(%q, %q, %q) = %q, want %q", tt.requested, tt.contentEncoding, tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrapDecompressorUnknownMode(t *testing.T) {
+	if _, err := wrapDecompressor("lzma", strings.NewReader("")); err == nil {
+		t.Fatal("expected an error for an unknown decompress mode")
+	}
+}
+
+func TestWrapDecompressorNone(t *testing.T) {
+	r, err := wrapDecompressor(decompressNone, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+func TestWrapDecompressorGzipRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write([]byte("hello, gzip")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r, err := wrapDecompressor(decompressGzip, &buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(got) != "hello, gzip" {
+		t.Errorf("got %q, want %q", got, "hello, gzip")
+	}
+}
+
+// TestTryRangeResumeElidesPrefixBytes proves the core claim of
+// --resume-from-head: on a successful range resume, the already-fetched
+// prefix is never read off the network at all. The test server only ever
+// serves bytes at or past the requested offset, so if the resumed body
+// contained the prefix, it could only have invented it.
+func TestTryRangeResumeElidesPrefixBytes(t *testing.T) {
+	const full = "0123456789ABCDEF"
+	const offset = 10
+	var gotRange, gotIfRange string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRange = r.Header.Get("Range")
+		gotIfRange = r.Header.Get("If-Range")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(full)-1, len(full)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(full[offset:]))
+	}))
+	defer srv.Close()
+
+	resp, ok, err := tryRangeResume(srv.URL, `"etag-1"`, offset, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ok {
+		t.Fatal("expected tryRangeResume to report ok on a 206")
+	}
+	defer resp.Body.Close()
+
+	if gotRange != fmt.Sprintf("bytes=%d-", offset) {
+		t.Errorf("Range header = %q, want bytes=%d-", gotRange, offset)
+	}
+	if gotIfRange != `"etag-1"` {
+		t.Errorf("If-Range header = %q, want %q", gotIfRange, `"etag-1"`)
+	}
+
+	got, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(got) != full[offset:] {
+		t.Errorf("resumed body = %q, want only the suffix %q (the prefix must never be re-fetched)", got, full[offset:])
+	}
+}
+
+func TestTryRangeResumeFallsBackWhenServerIgnoresRange(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("everything, from the top"))
+	}))
+	defer srv.Close()
+
+	_, ok, err := tryRangeResume(srv.URL, `"etag-1"`, 5, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ok {
+		t.Fatal("expected tryRangeResume to report !ok when the server doesn't honor the range")
+	}
+}
+
+// TestResumingBodySignalsRestartRequired proves that when reopen can't
+// resume (the server stops honoring the range mid-stream), Read reports
+// that a restart is needed instead of silently surfacing the stale
+// transport error that triggered the reopen attempt in the first place.
+func TestResumingBodySignalsRestartRequired(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK) // never honors Range
+	}))
+	defer srv.Close()
+
+	rb := &resumingBody{
+		url:       srv.URL,
+		validator: `"etag-1"`,
+		body:      ioutil.NopCloser(&erroringReader{err: errors.New("connection reset")}),
+		retries:   maxFetchRetries - 1, // only one reopen attempt before giving up
+	}
+
+	n, err := rb.Read(make([]byte, 16))
+	if n != 0 {
+		t.Errorf("Read returned %d bytes, want 0", n)
+	}
+	if err != io.EOF {
+		t.Errorf("Read error = %v, want io.EOF so the in-progress blob build terminates cleanly", err)
+	}
+	if !rb.restartNeeded {
+		t.Error("expected restartNeeded to be set so the caller restarts the fetch from byte 0")
+	}
+}
+
+func TestWatchStatsRecordCommit(t *testing.T) {
+	s := &watchStats{}
+	s.record(outcome{statusCode: 200, committed: true, bytes: 42, headHash: "#abc"}, nil)
+
+	if s.Commits != 1 {
+		t.Errorf("Commits = %d, want 1", s.Commits)
+	}
+	if s.BytesTransferred != 42 {
+		t.Errorf("BytesTransferred = %d, want 42", s.BytesTransferred)
+	}
+	if s.Head != "#abc" {
+		t.Errorf("Head = %q, want %q", s.Head, "#abc")
+	}
+	if s.LastStatusCode != 200 {
+		t.Errorf("LastStatusCode = %d, want 200", s.LastStatusCode)
+	}
+	if s.LastError != "" {
+		t.Errorf("LastError = %q, want empty", s.LastError)
+	}
+}
+
+func TestWatchStatsRecordNotModifiedDoesNotCountAsCommit(t *testing.T) {
+	s := &watchStats{Commits: 3}
+	s.record(outcome{statusCode: http.StatusNotModified, notModified: true}, nil)
+
+	if s.Commits != 3 {
+		t.Errorf("Commits = %d, want unchanged at 3", s.Commits)
+	}
+	if s.LastStatusCode != http.StatusNotModified {
+		t.Errorf("LastStatusCode = %d, want %d", s.LastStatusCode, http.StatusNotModified)
+	}
+}
+
+func TestWatchStatsRecordErrorClearsOnNextSuccess(t *testing.T) {
+	s := &watchStats{}
+	s.record(outcome{statusCode: 503}, errors.New("server unavailable"))
+	if s.LastError != "server unavailable" {
+		t.Errorf("LastError = %q, want %q", s.LastError, "server unavailable")
+	}
+
+	s.record(outcome{statusCode: 200, committed: true}, nil)
+	if s.LastError != "" {
+		t.Errorf("LastError = %q, want cleared after a successful fetch", s.LastError)
+	}
+}
+
+// TestFetchHTTPAndBuildBlobSkipsResumeWhenDecompressing proves resume-from-
+// head doesn't attempt a Range request against a compressed source: prevBlob
+// holds decompressed content, so prevBlob.Len() is the wrong offset to ask a
+// compressed wire stream for. The server below ignores Range and always
+// answers 200 with the whole gzipped body, so a wrong resume attempt would
+// fall back to a full fetch; the handler therefore keeps any Range header it
+// is ever sent, not just the last request's, and the test fails if one was.
+func TestFetchHTTPAndBuildBlobSkipsResumeWhenDecompressing(t *testing.T) {
+	const want = "hello, gzip, resumed from the top"
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write([]byte(want)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	gzipped := buf.Bytes()
+
+	var gotRange string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rg := r.Header.Get("Range"); rg != "" {
+			gotRange = rg
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Etag", `"etag-1"`)
+		w.Write(gzipped)
+	}))
+	defer srv.Close()
+
+	db := datas.NewDatabase(chunks.NewMemoryStore())
+	defer db.Close()
+
+	prevBlob := types.NewBlob(db, strings.NewReader(want))
+
+	blob, _, notModified, _, _, err := fetchHTTPAndBuildBlob(db, srv.URL, prevBlob, true, `"etag-1"`, `"etag-1"`, "", fetchOpts{
+		resumeFromHead: true,
+		decompress:     decompressGzip,
+		noProgress:     true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if notModified {
+		t.Fatal("expected a full fetch, not a 304")
+	}
+	if gotRange != "" {
+		t.Errorf("Range header = %q, want none: a compressed source must never be resumed from a decompressed-length offset", gotRange)
+	}
+
+	got, err := ioutil.ReadAll(blob.Reader())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(got) != want {
+		t.Errorf("blob content = %q, want %q", got, want)
+	}
+}
+
+type erroringReader struct{ err error }
+
+func (r *erroringReader) Read([]byte) (int, error) { return 0, r.err }
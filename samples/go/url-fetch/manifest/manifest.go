@@ -0,0 +1,52 @@
+// Copyright 2016 Attic Labs, Inc. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// Package manifest describes a batch of url-fetch jobs to run against one
+// shared noms database, as consumed by url-fetch's --manifest flag.
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Entry is one {url, dataset, headers, decompress, sha256} job: fetch URL
+// and commit it to Dataset, within the database the manifest as a whole is
+// run against.
+type Entry struct {
+	URL        string            `json:"url"`
+	Dataset    string            `json:"dataset"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Decompress string            `json:"decompress,omitempty"`
+	SHA256     string            `json:"sha256,omitempty"`
+}
+
+// Load reads a manifest file. Only JSON (a top-level array of Entry) is
+// supported; this is an intentional scoped-down v1 rather than an oversight
+// — a YAML manifest would need a vendored YAML parser, and nothing in this
+// repo pulls one in for this.
+func Load(path string) ([]Entry, error) {
+	if !strings.HasSuffix(path, ".json") {
+		return nil, fmt.Errorf("unsupported manifest format %q: only .json manifests are supported", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("could not parse manifest %s: %s", path, err)
+	}
+	for i, e := range entries {
+		if e.URL == "" || e.Dataset == "" {
+			return nil, fmt.Errorf("manifest entry %d is missing url or dataset", i)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2016 Attic Labs, Inc. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+package manifest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeManifest(t *testing.T, dir, name, contents string) string {
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return p
+}
+
+func TestLoadRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest_test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := writeManifest(t, dir, "jobs.json", `[
+		{"url": "http://example.com/a", "dataset": "db:a"},
+		{"url": "http://example.com/b", "dataset": "db:b", "headers": {"Authorization": "token x"}, "decompress": "gzip", "sha256": "deadbeef"}
+	]`)
+
+	entries, err := Load(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+
+	want := Entry{URL: "http://example.com/b", Dataset: "db:b", Headers: map[string]string{"Authorization": "token x"}, Decompress: "gzip", SHA256: "deadbeef"}
+	got := entries[1]
+	if got.URL != want.URL || got.Dataset != want.Dataset || got.Decompress != want.Decompress || got.SHA256 != want.SHA256 {
+		t.Errorf("entries[1] = %+v, want %+v", got, want)
+	}
+	if got.Headers["Authorization"] != want.Headers["Authorization"] {
+		t.Errorf("entries[1].Headers = %+v, want %+v", got.Headers, want.Headers)
+	}
+}
+
+func TestLoadRejectsNonJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest_test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := writeManifest(t, dir, "jobs.yaml", `- url: http://example.com/a`)
+	if _, err := Load(p); err == nil {
+		t.Fatal("expected an error for a non-.json manifest")
+	}
+}
+
+func TestLoadRequiresURLAndDataset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest_test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := writeManifest(t, dir, "jobs.json", `[{"url": "http://example.com/a"}]`)
+	if _, err := Load(p); err == nil {
+		t.Fatal("expected an error for an entry missing its dataset")
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := Load(filepath.Join(os.TempDir(), "does-not-exist.json")); err == nil {
+		t.Fatal("expected an error for a missing manifest file")
+	}
+}
@@ -0,0 +1,437 @@
+// Copyright 2016 Attic Labs, Inc. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+// url-tree mirrors a local directory, or a remote tree an HTTP index can be
+// crawled for (an Apache/Nginx autoindex, or an S3 ListObjectsV2 bucket
+// listing), into a noms Map<path, Blob> keyed by path relative to the root.
+// It's the multi-file sibling of url-fetch, which only ever writes a single
+// blob.
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/attic-labs/noms/go/config"
+	"github.com/attic-labs/noms/go/d"
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/marshal"
+	"github.com/attic-labs/noms/go/spec"
+	"github.com/attic-labs/noms/go/types"
+	"github.com/attic-labs/noms/go/util/exit"
+	"github.com/attic-labs/noms/go/util/progressreader"
+	"github.com/attic-labs/noms/go/util/status"
+	"github.com/attic-labs/noms/go/util/verbose"
+	flag "gx/ipfs/QmQLaYRd41dEe13kYwHtKBfXkkZuXzAEsKz56FA17NNT8A/gnuflag"
+)
+
+// entry describes one file discovered under the root, prior to fetching.
+// fetch is given the Etag recorded for this path on the last run (empty if
+// there wasn't one, or this is the first run) so it can perform a
+// conditional GET / conditional open and report notModified without ever
+// opening a reader, instead of downloading or re-reading content that
+// hasn't changed. If r is non-nil the caller is responsible for closing it.
+type entry struct {
+	relPath string
+	fetch   func(prevEtag string) (r io.ReadCloser, size int64, etag string, notModified bool, err error)
+}
+
+// entryMeta is what's recorded per path in the commit meta, so a later run
+// can conditionally GET only the paths whose Etag changed.
+type entryMeta struct {
+	Size int64  `noms:"size"`
+	Etag string `noms:"etag,omitempty"`
+}
+
+func main() {
+	include := flag.String("include", "", "comma-separated glob patterns; only matching paths are mirrored")
+	exclude := flag.String("exclude", "", "comma-separated glob patterns; matching paths are skipped")
+	concurrency := flag.Int("concurrency", 8, "number of files to fetch concurrently")
+	noProgress := flag.Bool("no-progress", false, "prevents progress from being output if true")
+	performCommit := flag.Bool("commit", true, "commit the data to head of the dataset (otherwise only write the data to the dataset)")
+
+	spec.RegisterCommitMetaFlags(flag.CommandLine)
+	verbose.RegisterVerboseFlags(flag.CommandLine)
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Mirrors a directory or crawlable URL into a noms Map<path, Blob>\n\nUsage: %s [source] [dataset]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse(true)
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		exit.Fail()
+	}
+
+	source := flag.Arg(0)
+	includes := splitPatterns(*include)
+	excludes := splitPatterns(*exclude)
+
+	cfg := config.NewResolver()
+	db, ds, err := cfg.GetDataset(flag.Arg(1))
+	d.CheckErrorNoUsage(err)
+	defer db.Close()
+
+	prevMeta := map[string]entryMeta{}
+	var prevMap types.Map
+	havePrevMap := false
+	if ds.HasHead() {
+		var root = struct {
+			Meta struct {
+				Entries map[string]entryMeta `noms:"entries,omitempty"`
+			}
+		}{}
+		if err := marshal.Unmarshal(ds.Head(), &root); err == nil {
+			prevMeta = root.Meta.Entries
+		}
+		if pm, ok := ds.Head().Get(datas.CommitValueField).(types.Map); ok {
+			prevMap, havePrevMap = pm, true
+		}
+	}
+
+	var entries []entry
+	if strings.HasPrefix(source, "http") {
+		entries, err = crawl(source)
+	} else {
+		entries, err = walkDir(source)
+	}
+	d.CheckErrorNoUsage(err)
+
+	entries = filterEntries(entries, includes, excludes)
+	if len(entries) == 0 {
+		fmt.Fprintf(os.Stderr, "No paths matched under %s\n", source)
+		return
+	}
+
+	headHash, numEntries, changed, err := mirror(db, &ds, entries, prevMeta, prevMap, havePrevMap, source, *concurrency, *noProgress, *performCommit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return
+	}
+
+	if !*performCommit {
+		fmt.Fprintf(os.Stdout, "#%s\n", headHash)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "Committed %d paths (%d changed)\n", numEntries, changed)
+}
+
+// mirror fetches every entry, skipping any whose e.fetch reports notModified
+// against prevMeta, and writes the resulting Map<path, Blob> into db. A
+// skipped path's blob is carried forward from prevMap rather than refetched,
+// so the result always covers every current path, not just the changed
+// ones. If performCommit, it also commits to the head of ds, recording a
+// {size, etag} entryMeta per path (a skipped path keeps its prevMeta entry)
+// under the commit meta's "entries" field so the next run's prevMeta can
+// repeat the skip. It returns the head
+// (or, if !performCommit, the written value's) hash, and the total/changed
+// path counts.
+func mirror(db datas.Database, ds *datas.Dataset, entries []entry, prevMeta map[string]entryMeta, prevMap types.Map, havePrevMap bool, source string, concurrency int, noProgress, performCommit bool) (string, int, int, error) {
+	type result struct {
+		path    string
+		blob    types.Blob
+		meta    entryMeta
+		skipped bool
+	}
+
+	jobs := make(chan entry)
+	results := make(chan result)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				func() {
+					r, size, etag, notModified, err := e.fetch(prevMeta[e.relPath].Etag)
+					d.CheckErrorNoUsage(err)
+					if notModified {
+						results <- result{path: e.relPath, skipped: true}
+						return
+					}
+					defer r.Close()
+
+					var rr io.Reader = r
+					if !noProgress {
+						rr = progressreader.New(rr, func(seenLen uint64) {
+							status.Printf("%s: %d bytes written...", e.relPath, seenLen)
+						})
+					}
+					b := types.NewBlob(db, rr)
+					results <- result{path: e.relPath, blob: b, meta: entryMeta{Size: size, Etag: etag}}
+				}()
+			}
+		}()
+	}
+
+	go func() {
+		for _, e := range entries {
+			jobs <- e
+		}
+		close(jobs)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	kv := []types.Value{}
+	newMeta := map[string]entryMeta{}
+	changed := 0
+	for res := range results {
+		if res.skipped {
+			newMeta[res.path] = prevMeta[res.path]
+			if havePrevMap {
+				if b, ok := prevMap.MaybeGet(types.String(res.path)); ok {
+					kv = append(kv, types.String(res.path), b)
+				}
+			}
+			continue
+		}
+		kv = append(kv, types.String(res.path), res.blob)
+		newMeta[res.path] = res.meta
+		changed++
+	}
+
+	m := types.NewMap(db, kv...)
+	if !noProgress {
+		status.Clear()
+	}
+
+	if !performCommit {
+		ref := db.WriteValue(m)
+		return ref.TargetHash().String(), len(newMeta), changed, nil
+	}
+
+	additionalMetaInfo := map[string]string{
+		"source":     source,
+		"numEntries": fmt.Sprintf("%d", len(newMeta)),
+		"changed":    fmt.Sprintf("%d", changed),
+	}
+	entriesVal, err := marshal.Marshal(db, newMeta)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	additionalStructuredMetaInfo := map[string]types.Value{"entries": entriesVal}
+	meta, err := spec.CreateCommitMetaStruct(db, "", "", additionalMetaInfo, additionalStructuredMetaInfo)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	newHead, err := db.Commit(*ds, m, datas.CommitOptions{Meta: meta})
+	if err != nil {
+		d.Chk.Equal(datas.ErrMergeNeeded, err)
+		return "", 0, 0, fmt.Errorf("could not commit, optimistic concurrency failed")
+	}
+	*ds = newHead
+	return ds.HeadRef().TargetHash().String(), len(newMeta), changed, nil
+}
+
+func splitPatterns(s string) []string {
+	if s == "" {
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
+func filterEntries(entries []entry, includes, excludes []string) []entry {
+	out := entries[:0]
+	for _, e := range entries {
+		if len(includes) > 0 && !matchesAny(includes, e.relPath) {
+			continue
+		}
+		if matchesAny(excludes, e.relPath) {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func matchesAny(patterns []string, relPath string) bool {
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, relPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// walkDir builds one entry per regular file under root. A local file's Etag
+// is synthesized from its mtime and size, which is enough to notice the
+// file changed without reading it; fetch only opens the file once that
+// synthetic Etag fails to match prevEtag.
+func walkDir(root string) ([]entry, error) {
+	var entries []entry
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{
+			relPath: filepath.ToSlash(rel),
+			fetch: func(prevEtag string) (io.ReadCloser, int64, string, bool, error) {
+				etag := fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+				if prevEtag != "" && prevEtag == etag {
+					return nil, 0, etag, true, nil
+				}
+				f, err := os.Open(p)
+				if err != nil {
+					return nil, 0, "", false, err
+				}
+				return f, info.Size(), etag, false, nil
+			},
+		})
+		return nil
+	})
+	return entries, err
+}
+
+// crawl discovers entries under a remote tree root. It understands S3's
+// ListObjectsV2 XML response and falls back to scraping href="..." links out
+// of an Apache/Nginx-style autoindex HTML page, recursing into any link
+// that looks like a subdirectory.
+func crawl(root string) ([]entry, error) {
+	if keys, ok := tryListS3(root); ok {
+		entries := make([]entry, len(keys))
+		for i, key := range keys {
+			url := root + key
+			entries[i] = entry{
+				relPath: key,
+				fetch:   func(prevEtag string) (io.ReadCloser, int64, string, bool, error) { return fetchHTTPFile(url, prevEtag) },
+			}
+		}
+		return entries, nil
+	}
+	return crawlAutoindex(root, "")
+}
+
+type s3ListResult struct {
+	XMLName  xml.Name `xml:"ListBucketResult"`
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+}
+
+func tryListS3(root string) ([]string, bool) {
+	resp, err := http.Get(root + "?list-type=2")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return nil, false
+	}
+	defer resp.Body.Close()
+
+	var result s3ListResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, false
+	}
+	keys := make([]string, len(result.Contents))
+	for i, c := range result.Contents {
+		keys[i] = c.Key
+	}
+	sort.Strings(keys)
+	return keys, true
+}
+
+func crawlAutoindex(root, relDir string) ([]entry, error) {
+	listURL := root + "/" + relDir
+	resp, err := http.Get(listURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("could not list %s: %d", listURL, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []entry
+	for _, href := range extractHrefs(string(body)) {
+		if href == "../" || href == "./" || strings.HasPrefix(href, "?") || strings.HasPrefix(href, "http") {
+			continue
+		}
+		rel := path.Join(relDir, href)
+		if strings.HasSuffix(href, "/") {
+			sub, err := crawlAutoindex(root, rel)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, sub...)
+			continue
+		}
+		url := root + "/" + rel
+		entries = append(entries, entry{
+			relPath: rel,
+			fetch:   func(prevEtag string) (io.ReadCloser, int64, string, bool, error) { return fetchHTTPFile(url, prevEtag) },
+		})
+	}
+	return entries, nil
+}
+
+func extractHrefs(html string) []string {
+	var hrefs []string
+	for {
+		i := strings.Index(html, `href="`)
+		if i < 0 {
+			break
+		}
+		html = html[i+len(`href="`):]
+		j := strings.Index(html, `"`)
+		if j < 0 {
+			break
+		}
+		hrefs = append(hrefs, html[:j])
+		html = html[j:]
+	}
+	return hrefs
+}
+
+// fetchHTTPFile issues a conditional GET for url, sending If-None-Match
+// when prevEtag is set, so an unchanged file's body is never downloaded.
+func fetchHTTPFile(url, prevEtag string) (io.ReadCloser, int64, string, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, "", false, err
+	}
+	if prevEtag != "" {
+		req.Header.Set("If-None-Match", prevEtag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, "", false, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+		return nil, 0, prevEtag, true, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, 0, "", false, fmt.Errorf("could not fetch %s: %d", url, resp.StatusCode)
+	}
+	return resp.Body, resp.ContentLength, resp.Header.Get("Etag"), false, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 Attic Labs, Inc. All rights reserved.
+// Licensed under the Apache License, version 2.0:
+// http://www.apache.org/licenses/LICENSE-2.0
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/attic-labs/noms/go/chunks"
+	"github.com/attic-labs/noms/go/datas"
+	"github.com/attic-labs/noms/go/marshal"
+	"github.com/attic-labs/noms/go/types"
+)
+
+func TestMatchesAny(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		relPath  string
+		want     bool
+	}{
+		{nil, "a/b.txt", false},
+		{[]string{"*.txt"}, "a/b.txt", false}, // filepath.Match doesn't cross path separators
+		{[]string{"a/*.txt"}, "a/b.txt", true},
+		{[]string{"*.json", "a/*.txt"}, "a/b.txt", true},
+		{[]string{"*.json"}, "a/b.txt", false},
+	}
+	for _, tt := range tests {
+		if got := matchesAny(tt.patterns, tt.relPath); got != tt.want {
+			t.Errorf("matchesAny(%v, %q) = %v, want %v", tt.patterns, tt.relPath, got, tt.want)
+		}
+	}
+}
+
+func TestFilterEntries(t *testing.T) {
+	all := []entry{{relPath: "a/one.txt"}, {relPath: "a/two.json"}, {relPath: "b/three.txt"}}
+
+	tests := []struct {
+		name     string
+		includes []string
+		excludes []string
+		want     []string
+	}{
+		{"no filters keeps everything", nil, nil, []string{"a/one.txt", "a/two.json", "b/three.txt"}},
+		{"include restricts to matches", []string{"a/*"}, nil, []string{"a/one.txt", "a/two.json"}},
+		{"exclude removes matches", nil, []string{"*/*.json"}, []string{"a/one.txt", "b/three.txt"}},
+		{"include and exclude compose", []string{"a/*"}, []string{"a/*.json"}, []string{"a/one.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filterEntries(append([]entry{}, all...), tt.includes, tt.excludes)
+			if len(got) != len(tt.want) {
+				t.Fatalf("filterEntries() = %d entries, want %d", len(got), len(tt.want))
+			}
+			for i, e := range got {
+				if e.relPath != tt.want[i] {
+					t.Errorf("filterEntries()[%d] = %q, want %q", i, e.relPath, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// loadPrevMeta reproduces main's own read of the previous run's per-path
+// meta, so the test observes exactly what a real second run would see.
+func loadPrevMeta(t *testing.T, ds datas.Dataset) (map[string]entryMeta, types.Map, bool) {
+	if !ds.HasHead() {
+		return map[string]entryMeta{}, types.Map{}, false
+	}
+	var root = struct {
+		Meta struct {
+			Entries map[string]entryMeta `noms:"entries,omitempty"`
+		}
+	}{}
+	if err := marshal.Unmarshal(ds.Head(), &root); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	pm, ok := ds.Head().Get(datas.CommitValueField).(types.Map)
+	return root.Meta.Entries, pm, ok
+}
+
+// TestMirrorSkipsUnchangedPathsOnSecondRun proves the per-path meta actually
+// round-trips through the commit: a second run against the same dataset,
+// with the same files on disk, should fetch nothing and report 0 changed,
+// while the committed Map still holds every path.
+func TestMirrorSkipsUnchangedPathsOnSecondRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "url_tree_test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("content of "+name), 0644); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	db := datas.NewDatabase(chunks.NewMemoryStore())
+	defer db.Close()
+	ds := db.GetDataset("url-tree-test")
+
+	entries, err := walkDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	prevMeta, prevMap, havePrevMap := loadPrevMeta(t, ds)
+	_, numEntries, changed, err := mirror(db, &ds, entries, prevMeta, prevMap, havePrevMap, dir, 2, true, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if numEntries != 2 || changed != 2 {
+		t.Fatalf("first run: numEntries=%d changed=%d, want 2, 2", numEntries, changed)
+	}
+
+	entries, err = walkDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	prevMeta, prevMap, havePrevMap = loadPrevMeta(t, ds)
+	if len(prevMeta) != 2 {
+		t.Fatalf("expected the first commit's meta to carry 2 entries forward, got %d", len(prevMeta))
+	}
+	if !havePrevMap {
+		t.Fatal("expected the first commit's value to be readable as a types.Map")
+	}
+
+	_, numEntries, changed, err = mirror(db, &ds, entries, prevMeta, prevMap, havePrevMap, dir, 2, true, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if changed != 0 {
+		t.Errorf("second run: changed=%d, want 0 (nothing on disk changed)", changed)
+	}
+	if numEntries != 2 {
+		t.Errorf("second run: numEntries=%d, want 2 (unchanged paths must still be carried forward)", numEntries)
+	}
+
+	m, ok := ds.Head().Get(datas.CommitValueField).(types.Map)
+	if !ok {
+		t.Fatal("expected the committed value to be a types.Map")
+	}
+	if m.Len() != 2 {
+		t.Errorf("committed Map has %d entries, want 2 (a skipped path must not drop out of the map)", m.Len())
+	}
+}